@@ -0,0 +1,152 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colfetcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/colexecop"
+	"github.com/cockroachdb/cockroach/pkg/sql/execinfra"
+	"github.com/cockroachdb/cockroach/pkg/sql/execinfrapb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// baseScanOperator factors out the state and behavior that a ScanOperator
+// implementation reading KV data through a cFetcher needs regardless of its
+// particular fetch strategy: tracing span lifecycle, rows-read accounting,
+// DrainMeta construction, and Close. ColBatchScan is the only embedder today.
+// Each embedding operator is responsible for its own Init/Next/Release as
+// well as anything that depends on its particular KV fetcher.
+type baseScanOperator struct {
+	colexecop.ZeroInputNode
+	colexecop.InitHelper
+
+	flowCtx *execinfra.FlowCtx
+	spans   roachpb.Spans
+
+	// tracingSpan is created when the stats should be collected for the query
+	// execution, and it will be finished when closing the operator.
+	tracingSpan *tracing.Span
+	mu          struct {
+		syncutil.Mutex
+		// rowsRead contains the number of total rows this operator has
+		// returned so far.
+		rowsRead int64
+	}
+}
+
+// init starts the child tracing span for this operator, if tracing is
+// enabled, updating b.Ctx in place. It should be called by the embedding
+// operator's Init method, after InitHelper.Init has returned true, with a
+// span name specific to that operator (e.g. "colbatchscan").
+func (b *baseScanOperator) init(spanName string) {
+	// If tracing is enabled, we need to start a child span so that the only
+	// contention events present in the recording would be because of this
+	// fetcher. Note that ProcessorSpan method itself will check whether
+	// tracing is enabled.
+	b.Ctx, b.tracingSpan = execinfra.ProcessorSpan(b.Ctx, spanName)
+}
+
+// recordRowsRead adds n to the running count of rows read by this operator.
+func (b *baseScanOperator) recordRowsRead(n int64) {
+	b.mu.Lock()
+	b.mu.rowsRead += n
+	b.mu.Unlock()
+}
+
+// hydrateTypes ensures that the given column types coming from a table
+// descriptor are hydrated. In the row execution engine this is done during
+// processor initialization, but neither ColBatchScan nor the cFetcher are
+// processors, so the embedding operator must do it itself before
+// constructing its ResultTypes.
+func (b *baseScanOperator) hydrateTypes(
+	ctx context.Context, evalCtx *tree.EvalContext, typs []*types.T,
+) error {
+	resolver := b.flowCtx.TypeResolverFactory.NewTypeResolver(evalCtx.Txn)
+	return resolver.HydrateTypeSlice(ctx, typs)
+}
+
+// getBytesRead is the shared implementation backing GetBytesRead. It takes
+// the embedder's accessor for its KV fetcher's byte count rather than owning
+// the fetcher itself, since the concrete fetcher type differs by operator.
+// The mutex acquisition mirrors that of recordRowsRead / GetRowsRead so that
+// a concurrent call to Init has to wait, and the fetcher remains
+// uninitialized until we return (in which case fetcherBytesRead should
+// return 0).
+func (b *baseScanOperator) getBytesRead(fetcherBytesRead func() int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return fetcherBytesRead()
+}
+
+// GetRowsRead is part of the colexecop.KVReader interface.
+func (b *baseScanOperator) GetRowsRead() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.mu.rowsRead
+}
+
+// GetCumulativeContentionTime is part of the colexecop.KVReader interface.
+func (b *baseScanOperator) GetCumulativeContentionTime() time.Duration {
+	return execinfra.GetCumulativeContentionTime(b.Ctx)
+}
+
+// drainMeta is the shared implementation backing DrainMeta. bytesRead and
+// rowsRead are supplied by the embedder (typically via its own GetBytesRead
+// and GetRowsRead). extraMetrics, if non-nil, is called with the
+// ProducerMetadata's Metrics so that the embedder can attach metrics that
+// are specific to it before the metadata is finalized.
+func (b *baseScanOperator) drainMeta(
+	bytesRead, rowsRead int64, extraMetrics func(*execinfrapb.MetricsMetadata),
+) []execinfrapb.ProducerMetadata {
+	var trailingMeta []execinfrapb.ProducerMetadata
+	if !b.flowCtx.Local {
+		nodeID, ok := b.flowCtx.NodeID.OptionalNodeID()
+		if ok {
+			ranges := execinfra.MisplannedRanges(b.Ctx, b.spans, nodeID, b.flowCtx.Cfg.RangeCache)
+			if ranges != nil {
+				trailingMeta = append(trailingMeta, execinfrapb.ProducerMetadata{Ranges: ranges})
+			}
+		}
+	}
+	if tfs := execinfra.GetLeafTxnFinalState(b.Ctx, b.flowCtx.Txn); tfs != nil {
+		trailingMeta = append(trailingMeta, execinfrapb.ProducerMetadata{LeafTxnFinalState: tfs})
+	}
+	meta := execinfrapb.GetProducerMeta()
+	meta.Metrics = execinfrapb.GetMetricsMeta()
+	meta.Metrics.BytesRead = bytesRead
+	meta.Metrics.RowsRead = rowsRead
+	if extraMetrics != nil {
+		extraMetrics(meta.Metrics)
+	}
+	trailingMeta = append(trailingMeta, *meta)
+	if trace := execinfra.GetTraceData(b.Ctx); trace != nil {
+		trailingMeta = append(trailingMeta, execinfrapb.ProducerMetadata{TraceData: trace})
+	}
+	return trailingMeta
+}
+
+// close is the shared implementation backing Close. closeFetcher is called
+// with the operator's context so the embedder can close its own KV fetcher
+// before the tracing span is finished.
+func (b *baseScanOperator) close(closeFetcher func(ctx context.Context)) error {
+	closeFetcher(b.EnsureCtx())
+	if b.tracingSpan != nil {
+		b.tracingSpan.Finish()
+		b.tracingSpan = nil
+	}
+	return nil
+}
@@ -13,10 +13,10 @@ package colfetcher
 import (
 	"context"
 	"sync"
-	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/col/coldata"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog/tabledesc"
 	"github.com/cockroachdb/cockroach/pkg/sql/colexecerror"
@@ -29,10 +29,63 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/types"
 	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
-	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/cockroachdb/errors"
 )
 
+// storeBatchSizeSetting controls the group size used when computing
+// GetStoreBatchStats: how many adjacent spans targeting the same leaseholder
+// store a ColBatchScan's span set would coalesce into a group, were
+// request-level coalescing implemented (see groupSpansByStore). Setting it
+// to 0 or 1 disables grouping for that purpose.
+//
+// NB: ColBatchScan does not actually issue a separate, coalesced KV request
+// per group -- actually batching adjacent-by-store spans into a single
+// BatchRequest (and demultiplexing the response back to per-span results)
+// requires changes to cFetcher and the KV DistSender that are outside this
+// package. This setting, and the grouping it drives, only surface the
+// batching opportunity via GetStoreBatchStats; the scan itself is always
+// issued as a single rf.StartScan call over all of s.spans.
+var storeBatchSizeSetting = settings.RegisterIntSetting(
+	settings.TenantWritable,
+	"sql.distsql.store_batch_size",
+	"the maximum number of adjacent spans targeting the same store that "+
+		"would be coalesced into a single request, if request-level "+
+		"coalescing were implemented (0 or 1 disables the grouping used to "+
+		"compute this); see GetStoreBatchStats",
+	4,
+	settings.NonNegativeInt,
+)
+
+// initialBatchSizeHintScaleSetting scales the summed row-count hints (when
+// available; see rowCountHints) before they're used to decide whether this
+// scan's batches should be capped at batchBytesLimit or left unbounded (see
+// limitBatches). A value of 1 uses the hints' sum as-is; lower values bias
+// towards treating the scan as "small" (i.e. unbounded), leaving headroom
+// for estimation error.
+//
+// NB: this only drives the limit-vs-unbounded decision for the scan as a
+// whole; ColBatchScan does not dispatch anything concurrently (it issues a
+// single rf.StartScan call -- see Init), so there's no notion of scheduling
+// one part of the scan "in parallel with" another to decide between here.
+//
+// TODO(yuzefovich): using the hints to also size cFetcher's initial
+// coldata.Batch allocation per span (instead of always pre-allocating 1024
+// rows, see the TODO below) requires threading them into cFetcher itself,
+// which isn't part of this package.
+var initialBatchSizeHintScaleSetting = settings.RegisterFloatSetting(
+	settings.TenantWritable,
+	"sql.distsql.scan.initial_batch_size_hint_scale",
+	"the scale factor applied to the summed row-count hints when deciding "+
+		"whether to limit batches for a scan",
+	1.0,
+	settings.PositiveFloat,
+)
+
+// smallScanRowCountThreshold is the (scaled) summed row-count hint below
+// which a scan is considered small enough to run without limiting batches,
+// per initialBatchSizeHintScaleSetting.
+const smallScanRowCountThreshold = 1024
+
 // TODO(yuzefovich): reading the data through a pair of ColBatchScan and
 // materializer turns out to be more efficient than through a table reader (at
 // the moment, the exception is the case of reading very small number of rows
@@ -43,26 +96,37 @@ import (
 
 // ColBatchScan is the exec.Operator implementation of TableReader. It reads a
 // table from kv, presenting it as coldata.Batches via the exec.Operator
-// interface.
+// interface. It embeds baseScanOperator for the tracing, rows-read
+// accounting, DrainMeta, and Close behavior that's shared across
+// ScanOperator implementations.
 type ColBatchScan struct {
-	colexecop.ZeroInputNode
-	colexecop.InitHelper
+	baseScanOperator
 
-	spans           roachpb.Spans
-	flowCtx         *execinfra.FlowCtx
 	bsHeader        *roachpb.BoundedStalenessHeader
 	rf              *cFetcher
 	limitHint       rowinfra.RowLimit
 	batchBytesLimit rowinfra.BytesLimit
 	parallelize     bool
-	// tracingSpan is created when the stats should be collected for the query
-	// execution, and it will be finished when closing the operator.
-	tracingSpan *tracing.Span
-	mu          struct {
+	// storeBatchSize is the maximum number of adjacent spans resolving to the
+	// same leaseholder store that groupSpansByStore puts into one group when
+	// computing GetStoreBatchStats. It does not change how the scan is issued.
+	// A value of 0 or 1 disables the grouping. See the
+	// sql.distsql.store_batch_size cluster setting.
+	storeBatchSize int
+	// rowCountHints, if non-nil, contains a per-span estimated row count, one
+	// entry per span in spans, as populated by the optimizer from table
+	// statistics.
+	rowCountHints []uint64
+
+	mu struct {
 		syncutil.Mutex
-		// rowsRead contains the number of total rows this ColBatchScan has
-		// returned so far.
-		rowsRead int64
+		// batchedRequests and unbatchedRequests track how many of the groups
+		// groupSpansByStore forms for this scan's spans coalesce multiple
+		// spans targeting the same store versus are singletons. Exposed via
+		// GetStoreBatchStats; see the NB on storeBatchSizeSetting for why
+		// this is diagnostic only.
+		batchedRequests   int64
+		unbatchedRequests int64
 	}
 	// ResultTypes is the slice of resulting column types from this operator.
 	// It should be used rather than the slice of column types from the scanned
@@ -71,7 +135,7 @@ type ColBatchScan struct {
 }
 
 // ScanOperator combines common interfaces between operators that perform KV
-// scans, such as ColBatchScan and ColIndexJoin.
+// scans, such as ColBatchScan.
 type ScanOperator interface {
 	colexecop.KVReader
 	execinfra.Releasable
@@ -85,18 +149,30 @@ func (s *ColBatchScan) Init(ctx context.Context) {
 	if !s.InitHelper.Init(ctx) {
 		return
 	}
-	// If tracing is enabled, we need to start a child span so that the only
-	// contention events present in the recording would be because of this
-	// cFetcher. Note that ProcessorSpan method itself will check whether
-	// tracing is enabled.
-	s.Ctx, s.tracingSpan = execinfra.ProcessorSpan(s.Ctx, "colbatchscan")
-	limitBatches := !s.parallelize
+	s.baseScanOperator.init("colbatchscan")
+	// Store batching is incompatible with a bounded-staleness header, since
+	// each range in the batch may need its own negotiated timestamp.
+	storeBatchSize := s.storeBatchSize
+	if s.bsHeader != nil {
+		storeBatchSize = 0
+	}
+	if s.tracingSpan != nil {
+		// Computing this involves a leaseholder lookup per span, so it's only
+		// worth doing when something is actually collecting stats for this
+		// operator. See the NB on storeBatchSizeSetting: it only records
+		// diagnostics and doesn't change how the scan below is issued.
+		locate := func(ctx context.Context, key roachpb.Key) (roachpb.StoreID, bool) {
+			return storeForKey(ctx, s.flowCtx.Cfg.RangeCache, key)
+		}
+		s.recordGroupStats(groupSpansByStore(s.Ctx, s.spans, storeBatchSize, locate, s.rowCountHints))
+	}
+
 	if err := s.rf.StartScan(
 		s.Ctx,
 		s.flowCtx.Txn,
 		s.spans,
 		s.bsHeader,
-		limitBatches,
+		s.limitBatches(),
 		s.batchBytesLimit,
 		s.limitHint,
 		s.flowCtx.TraceKV,
@@ -106,6 +182,58 @@ func (s *ColBatchScan) Init(ctx context.Context) {
 	}
 }
 
+// limitBatches decides whether this scan should limit batches (i.e. wait
+// for backpressure rather than racing ahead of the consumer) or not. A
+// small (scaled) summed row-count hint is considered cheap enough to leave
+// unbounded; no hint, or a large one, is treated conservatively and
+// limited. See the NB on initialBatchSizeHintScaleSetting: this chooses one
+// setting for the scan as a whole, not a per-span or concurrent schedule.
+func (s *ColBatchScan) limitBatches() bool {
+	if s.parallelize {
+		// The operator-wide parallelize flag, when set, already disables
+		// batch limiting for everything.
+		return false
+	}
+	if len(s.rowCountHints) == 0 {
+		return true
+	}
+	var sum uint64
+	for _, h := range s.rowCountHints {
+		sum += h
+	}
+	scale := initialBatchSizeHintScaleSetting.Get(&s.flowCtx.Cfg.Settings.SV)
+	scaledHint := uint64(float64(sum) * scale)
+	return scaledHint >= smallScanRowCountThreshold
+}
+
+// recordGroupStats updates GetStoreBatchStats' counters from the groups
+// groupSpansByStore forms for this scan's spans. See the NB on
+// storeBatchSizeSetting for why this is diagnostic only.
+func (s *ColBatchScan) recordGroupStats(groups []spanGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, g := range groups {
+		if len(g.spans) > 1 {
+			s.mu.batchedRequests++
+		} else {
+			s.mu.unbatchedRequests++
+		}
+	}
+}
+
+// GetStoreBatchStats returns the number of store-adjacent span groups this
+// scan's spans would form that coalesce multiple spans targeting the same
+// store, and the number that are singletons. The counts are only computed in
+// Init when a tracing span was started for this operator; otherwise both are
+// 0. It's diagnostic only -- see the
+// NB on storeBatchSizeSetting for why ColBatchScan doesn't issue a separate,
+// coalesced request per group today.
+func (s *ColBatchScan) GetStoreBatchStats() (batched, unbatched int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mu.batchedRequests, s.mu.unbatchedRequests
+}
+
 // Next is part of the Operator interface.
 func (s *ColBatchScan) Next() coldata.Batch {
 	bat, err := s.rf.NextBatch(s.Ctx)
@@ -115,59 +243,21 @@ func (s *ColBatchScan) Next() coldata.Batch {
 	if bat.Selection() != nil {
 		colexecerror.InternalError(errors.AssertionFailedf("unexpectedly a selection vector is set on the batch coming from CFetcher"))
 	}
-	s.mu.Lock()
-	s.mu.rowsRead += int64(bat.Length())
-	s.mu.Unlock()
+	s.recordRowsRead(int64(bat.Length()))
 	return bat
 }
 
 // DrainMeta is part of the colexecop.MetadataSource interface.
 func (s *ColBatchScan) DrainMeta() []execinfrapb.ProducerMetadata {
-	var trailingMeta []execinfrapb.ProducerMetadata
-	if !s.flowCtx.Local {
-		nodeID, ok := s.flowCtx.NodeID.OptionalNodeID()
-		if ok {
-			ranges := execinfra.MisplannedRanges(s.Ctx, s.spans, nodeID, s.flowCtx.Cfg.RangeCache)
-			if ranges != nil {
-				trailingMeta = append(trailingMeta, execinfrapb.ProducerMetadata{Ranges: ranges})
-			}
-		}
-	}
-	if tfs := execinfra.GetLeafTxnFinalState(s.Ctx, s.flowCtx.Txn); tfs != nil {
-		trailingMeta = append(trailingMeta, execinfrapb.ProducerMetadata{LeafTxnFinalState: tfs})
-	}
-	meta := execinfrapb.GetProducerMeta()
-	meta.Metrics = execinfrapb.GetMetricsMeta()
-	meta.Metrics.BytesRead = s.GetBytesRead()
-	meta.Metrics.RowsRead = s.GetRowsRead()
-	trailingMeta = append(trailingMeta, *meta)
-	if trace := execinfra.GetTraceData(s.Ctx); trace != nil {
-		trailingMeta = append(trailingMeta, execinfrapb.ProducerMetadata{TraceData: trace})
-	}
-	return trailingMeta
+	return s.drainMeta(s.GetBytesRead(), s.GetRowsRead(), nil /* extraMetrics */)
 }
 
-// GetBytesRead is part of the colexecop.KVReader interface.
+// GetBytesRead is part of the colexecop.KVReader interface. Since s.rf's
+// entire scan is issued via a single rf.StartScan call (see Init), this is a
+// plain passthrough -- there's no second session whose byte count would need
+// to be accumulated on top of it.
 func (s *ColBatchScan) GetBytesRead() int64 {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	// Note that if Init() was never called, s.rf.fetcher will remain nil, and
-	// GetBytesRead() will return 0. We are also holding the mutex, so a
-	// concurrent call to Init() will have to wait, and the fetcher will remain
-	// uninitialized until we return.
-	return s.rf.fetcher.GetBytesRead()
-}
-
-// GetRowsRead is part of the colexecop.KVReader interface.
-func (s *ColBatchScan) GetRowsRead() int64 {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.mu.rowsRead
-}
-
-// GetCumulativeContentionTime is part of the colexecop.KVReader interface.
-func (s *ColBatchScan) GetCumulativeContentionTime() time.Duration {
-	return execinfra.GetCumulativeContentionTime(s.Ctx)
+	return s.getBytesRead(func() int64 { return s.rf.fetcher.GetBytesRead() })
 }
 
 var colBatchScanPool = sync.Pool{
@@ -177,6 +267,12 @@ var colBatchScanPool = sync.Pool{
 }
 
 // NewColBatchScan creates a new ColBatchScan operator.
+//
+// rowCountHints, if non-nil, is a per-span estimated row count from the
+// optimizer, one entry per span in spec.Spans; pass nil when unavailable.
+// TODO(yuzefovich): once TableReaderSpec grows a FixedRowCountHints field
+// (tracked separately -- that proto isn't part of this package), callers
+// should source this from the spec instead of passing it explicitly.
 func NewColBatchScan(
 	ctx context.Context,
 	allocator *colmem.Allocator,
@@ -185,6 +281,7 @@ func NewColBatchScan(
 	spec *execinfrapb.TableReaderSpec,
 	post *execinfrapb.PostProcessSpec,
 	estimatedRowCount uint64,
+	rowCountHints []uint64,
 ) (*ColBatchScan, error) {
 	// NB: we hit this with a zero NodeID (but !ok) with multi-tenancy.
 	if nodeID, ok := flowCtx.NodeID.OptionalNodeID(); nodeID == 0 && ok {
@@ -268,19 +365,56 @@ func NewColBatchScan(
 		}
 	}
 
+	storeBatchSize := int(storeBatchSizeSetting.Get(&flowCtx.Cfg.Settings.SV))
+	rowCountHints = validateRowCountHints(rowCountHints, len(spans), estimatedRowCount)
+
 	*s = ColBatchScan{
-		spans:           spans,
-		flowCtx:         flowCtx,
+		baseScanOperator: baseScanOperator{
+			flowCtx: flowCtx,
+			spans:   spans,
+		},
 		bsHeader:        bsHeader,
 		rf:              fetcher,
 		limitHint:       limitHint,
 		batchBytesLimit: batchBytesLimit,
 		parallelize:     spec.Parallelize,
+		storeBatchSize:  storeBatchSize,
+		rowCountHints:   rowCountHints,
 		ResultTypes:     typs,
 	}
 	return s, nil
 }
 
+// validateRowCountHints returns hints unchanged if it has exactly one entry
+// per span and its entries roughly sum to estimatedRowCount (within a factor
+// of two in either direction), since the optimizer's estimate may be stale
+// relative to the hints it derived it from. When estimatedRowCount is 0, the
+// sum is not checked and hints with one entry per span are returned
+// unchanged. Otherwise it returns nil so that
+// callers fall back to the fetcher's default batch sizing behavior rather
+// than trusting a hint set that's inconsistent with reality.
+func validateRowCountHints(
+	hints []uint64, numSpans int, estimatedRowCount uint64,
+) []uint64 {
+	if len(hints) == 0 {
+		return nil
+	}
+	if len(hints) != numSpans {
+		return nil
+	}
+	if estimatedRowCount == 0 {
+		return hints
+	}
+	var sum uint64
+	for _, h := range hints {
+		sum += h
+	}
+	if sum < estimatedRowCount/2 || sum > estimatedRowCount*2 {
+		return nil
+	}
+	return hints
+}
+
 // retrieveTypsAndColOrds extracts logic that retrieves a slice with the column
 // types and a map between column IDs and ordinal positions for the columns from
 // the given table.
@@ -312,8 +446,8 @@ func retrieveTypsAndColOrds(
 	// make sure they are hydrated. In row execution engine it is done during
 	// the processor initialization, but neither ColBatchScan nor cFetcher are
 	// processors, so we need to do the hydration ourselves.
-	resolver := flowCtx.TypeResolverFactory.NewTypeResolver(evalCtx.Txn)
-	if err := resolver.HydrateTypeSlice(ctx, typs); err != nil {
+	b := baseScanOperator{flowCtx: flowCtx}
+	if err := b.hydrateTypes(ctx, evalCtx, typs); err != nil {
 		return nil, catalog.TableColMap{}, err
 	}
 
@@ -327,18 +461,14 @@ func (s *ColBatchScan) Release() {
 	for i := range s.spans {
 		s.spans[i] = roachpb.Span{}
 	}
+	spans := s.spans[:0]
 	*s = ColBatchScan{
-		spans: s.spans[:0],
+		baseScanOperator: baseScanOperator{spans: spans},
 	}
 	colBatchScanPool.Put(s)
 }
 
 // Close implements the colexecop.Closer interface.
 func (s *ColBatchScan) Close() error {
-	s.rf.Close(s.EnsureCtx())
-	if s.tracingSpan != nil {
-		s.tracingSpan.Finish()
-		s.tracingSpan = nil
-	}
-	return nil
+	return s.close(func(ctx context.Context) { s.rf.Close(ctx) })
 }
@@ -0,0 +1,131 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colfetcher
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/execinfra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRowCountHints(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		hints             []uint64
+		numSpans          int
+		estimatedRowCount uint64
+		expected          []uint64
+	}{
+		{
+			name:              "no hints",
+			hints:             nil,
+			numSpans:          3,
+			estimatedRowCount: 100,
+			expected:          nil,
+		},
+		{
+			name:              "mismatched length is rejected",
+			hints:             []uint64{10, 20},
+			numSpans:          3,
+			estimatedRowCount: 30,
+			expected:          nil,
+		},
+		{
+			name:              "zero estimate is trusted as-is",
+			hints:             []uint64{10, 20},
+			numSpans:          2,
+			estimatedRowCount: 0,
+			expected:          []uint64{10, 20},
+		},
+		{
+			name:              "sum within 2x of estimate is accepted",
+			hints:             []uint64{40, 40},
+			numSpans:          2,
+			estimatedRowCount: 100,
+			expected:          []uint64{40, 40},
+		},
+		{
+			name:              "sum far below estimate is rejected",
+			hints:             []uint64{1, 1},
+			numSpans:          2,
+			estimatedRowCount: 100,
+			expected:          nil,
+		},
+		{
+			name:              "sum far above estimate is rejected",
+			hints:             []uint64{1000, 1000},
+			numSpans:          2,
+			estimatedRowCount: 100,
+			expected:          nil,
+		},
+		{
+			name:              "sum exactly at the 2x boundary is accepted",
+			hints:             []uint64{200},
+			numSpans:          1,
+			estimatedRowCount: 100,
+			expected:          []uint64{200},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := validateRowCountHints(tc.hints, tc.numSpans, tc.estimatedRowCount)
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestLimitBatches(t *testing.T) {
+	st := cluster.MakeTestingClusterSettings()
+	newScan := func(parallelize bool, rowCountHints []uint64) *ColBatchScan {
+		return &ColBatchScan{
+			baseScanOperator: baseScanOperator{
+				flowCtx: &execinfra.FlowCtx{Cfg: &execinfra.ServerConfig{Settings: st}},
+			},
+			parallelize:   parallelize,
+			rowCountHints: rowCountHints,
+		}
+	}
+
+	for _, tc := range []struct {
+		name          string
+		parallelize   bool
+		rowCountHints []uint64
+		expected      bool
+	}{
+		{
+			name:          "parallelize disables limiting regardless of hints",
+			parallelize:   true,
+			rowCountHints: []uint64{10000},
+			expected:      false,
+		},
+		{
+			name:          "no hints limits conservatively",
+			rowCountHints: nil,
+			expected:      true,
+		},
+		{
+			name:          "small hinted scan is left unbounded",
+			rowCountHints: []uint64{10},
+			expected:      false,
+		},
+		{
+			name:          "large hinted scan is limited",
+			rowCountHints: []uint64{10000},
+			expected:      true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newScan(tc.parallelize, tc.rowCountHints)
+			require.Equal(t, tc.expected, s.limitBatches())
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colfetcher
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/kv/kvclient/rangecache"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+// spanGroup is a run of adjacent spans that resolve to the same leaseholder
+// store, along with the sum of their rowCountHints (0 if no hints were
+// available for these spans).
+type spanGroup struct {
+	spans        roachpb.Spans
+	rowCountHint uint64
+}
+
+// leaseholderStoreFn resolves the leaseholder store for a key, so that
+// adjacent spans can be grouped by target store. It's threaded into
+// groupSpansByStore as a function, rather than the range cache directly, so
+// that the grouping logic itself stays unit-testable with a fake. The real
+// implementation is storeForKey, which consults a *rangecache.RangeCache.
+type leaseholderStoreFn func(ctx context.Context, key roachpb.Key) (roachpb.StoreID, bool)
+
+// storeForKey resolves the leaseholder store for key by consulting the given
+// range cache. It returns ok=false if the lookup fails or no leaseholder is
+// known, in which case callers should treat the span as ungroupable and put
+// it in a group of its own.
+func storeForKey(
+	ctx context.Context, rangeCache *rangecache.RangeCache, key roachpb.Key,
+) (roachpb.StoreID, bool) {
+	if rangeCache == nil {
+		return 0, false
+	}
+	entry, err := rangeCache.Lookup(ctx, roachpb.RKey(key))
+	if err != nil {
+		return 0, false
+	}
+	lease := entry.Leaseholder()
+	if lease == nil {
+		return 0, false
+	}
+	return lease.StoreID, true
+}
+
+// groupSpansByStore partitions spans into spanGroups of at most
+// storeBatchSize adjacent spans that resolve to the same leaseholder store.
+// Today this is consumed only for diagnostics (see ColBatchScan's
+// GetStoreBatchStats and the NB on storeBatchSizeSetting); actually issuing
+// one coalesced KV request per group instead of one per span requires
+// changes to cFetcher and the KV DistSender that are outside this package.
+// Grouping only ever merges spans that are already adjacent in the input
+// order, so the relative order of spans -- and in particular the
+// reverse-scan order produced by the optimizer when spec.Reverse is set --
+// is always preserved; a future consumer that does dispatch per group would
+// never need to re-sort results.
+//
+// Spans whose store can't be resolved (locate returns ok=false, e.g. because
+// the range cache has no entry yet) are placed in their own singleton group
+// rather than failing the whole grouping. Passing storeBatchSize <= 1 or a nil
+// locate disables grouping entirely, also yielding one group per span.
+//
+// hints, if non-nil, must have one entry per span; the returned groups carry
+// the sum of the hints for the spans they contain.
+func groupSpansByStore(
+	ctx context.Context, spans roachpb.Spans, storeBatchSize int, locate leaseholderStoreFn, hints []uint64,
+) []spanGroup {
+	if len(spans) == 0 {
+		// Return a single empty group, mirroring the single (empty)
+		// rf.StartScan call that ColBatchScan.Init makes even when there's
+		// nothing to scan.
+		return []spanGroup{{}}
+	}
+	hintAt := func(i int) uint64 {
+		if i < len(hints) {
+			return hints[i]
+		}
+		return 0
+	}
+	if storeBatchSize <= 1 || locate == nil {
+		groups := make([]spanGroup, len(spans))
+		for i, sp := range spans {
+			groups[i] = spanGroup{spans: roachpb.Spans{sp}, rowCountHint: hintAt(i)}
+		}
+		return groups
+	}
+
+	var groups []spanGroup
+	var curStore roachpb.StoreID
+	var curOK bool
+	for i, sp := range spans {
+		store, ok := locate(ctx, sp.Key)
+		appendToLast := ok && curOK && store == curStore &&
+			len(groups) > 0 && len(groups[len(groups)-1].spans) < storeBatchSize
+		if appendToLast {
+			last := &groups[len(groups)-1]
+			last.spans = append(last.spans, sp)
+			last.rowCountHint += hintAt(i)
+		} else {
+			groups = append(groups, spanGroup{spans: roachpb.Spans{sp}, rowCountHint: hintAt(i)})
+		}
+		curStore, curOK = store, ok
+	}
+	return groups
+}
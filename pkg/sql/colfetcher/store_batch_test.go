@@ -0,0 +1,130 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package colfetcher
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/stretchr/testify/require"
+)
+
+// spanAt builds a single-key span, keyed by a single byte, so that tests can
+// identify spans by their starting letter.
+func spanAt(key byte) roachpb.Span {
+	return roachpb.Span{Key: roachpb.Key{key}}
+}
+
+// fakeLocate returns a leaseholderStoreFn that resolves each span's key
+// according to stores, and reports ok=false for any key not present in it --
+// simulating a range cache miss.
+func fakeLocate(stores map[byte]roachpb.StoreID) leaseholderStoreFn {
+	return func(_ context.Context, key roachpb.Key) (roachpb.StoreID, bool) {
+		store, ok := stores[key[0]]
+		return store, ok
+	}
+}
+
+func TestGroupSpansByStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("empty spans yields a single empty group", func(t *testing.T) {
+		groups := groupSpansByStore(ctx, nil, 4, fakeLocate(nil), nil)
+		require.Equal(t, []spanGroup{{}}, groups)
+	})
+
+	t.Run("storeBatchSize of 0 or 1 disables grouping", func(t *testing.T) {
+		spans := roachpb.Spans{spanAt('a'), spanAt('b')}
+		locate := fakeLocate(map[byte]roachpb.StoreID{'a': 1, 'b': 1})
+		for _, size := range []int{0, 1} {
+			groups := groupSpansByStore(ctx, spans, size, locate, nil)
+			require.Equal(t, []spanGroup{
+				{spans: roachpb.Spans{spanAt('a')}},
+				{spans: roachpb.Spans{spanAt('b')}},
+			}, groups)
+		}
+	})
+
+	t.Run("nil locate disables grouping", func(t *testing.T) {
+		spans := roachpb.Spans{spanAt('a'), spanAt('b')}
+		groups := groupSpansByStore(ctx, spans, 4, nil, nil)
+		require.Equal(t, []spanGroup{
+			{spans: roachpb.Spans{spanAt('a')}},
+			{spans: roachpb.Spans{spanAt('b')}},
+		}, groups)
+	})
+
+	t.Run("adjacent spans on the same store are coalesced", func(t *testing.T) {
+		spans := roachpb.Spans{spanAt('a'), spanAt('b'), spanAt('c')}
+		locate := fakeLocate(map[byte]roachpb.StoreID{'a': 1, 'b': 1, 'c': 1})
+		groups := groupSpansByStore(ctx, spans, 4, locate, nil)
+		require.Equal(t, []spanGroup{
+			{spans: roachpb.Spans{spanAt('a'), spanAt('b'), spanAt('c')}},
+		}, groups)
+	})
+
+	t.Run("a store change starts a new group", func(t *testing.T) {
+		spans := roachpb.Spans{spanAt('a'), spanAt('b'), spanAt('c')}
+		locate := fakeLocate(map[byte]roachpb.StoreID{'a': 1, 'b': 2, 'c': 1})
+		groups := groupSpansByStore(ctx, spans, 4, locate, nil)
+		require.Equal(t, []spanGroup{
+			{spans: roachpb.Spans{spanAt('a')}},
+			{spans: roachpb.Spans{spanAt('b')}},
+			{spans: roachpb.Spans{spanAt('c')}},
+		}, groups)
+	})
+
+	t.Run("non-adjacent spans on the same store are not reordered into one group", func(t *testing.T) {
+		// Even though 'a' and 'c' share a store, 'b' sits between them, so
+		// grouping must not reorder spans to merge 'a' and 'c' together.
+		spans := roachpb.Spans{spanAt('a'), spanAt('b'), spanAt('c')}
+		locate := fakeLocate(map[byte]roachpb.StoreID{'a': 1, 'b': 2, 'c': 1})
+		groups := groupSpansByStore(ctx, spans, 4, locate, nil)
+		require.Len(t, groups, 3)
+		require.Equal(t, spanAt('a'), groups[0].spans[0])
+		require.Equal(t, spanAt('b'), groups[1].spans[0])
+		require.Equal(t, spanAt('c'), groups[2].spans[0])
+	})
+
+	t.Run("groups are capped at storeBatchSize", func(t *testing.T) {
+		spans := roachpb.Spans{spanAt('a'), spanAt('b'), spanAt('c')}
+		locate := fakeLocate(map[byte]roachpb.StoreID{'a': 1, 'b': 1, 'c': 1})
+		groups := groupSpansByStore(ctx, spans, 2, locate, nil)
+		require.Equal(t, []spanGroup{
+			{spans: roachpb.Spans{spanAt('a'), spanAt('b')}},
+			{spans: roachpb.Spans{spanAt('c')}},
+		}, groups)
+	})
+
+	t.Run("a failed lookup falls back to a singleton group", func(t *testing.T) {
+		spans := roachpb.Spans{spanAt('a'), spanAt('b'), spanAt('c')}
+		// 'b' has no entry in the map, so locate reports ok=false for it.
+		locate := fakeLocate(map[byte]roachpb.StoreID{'a': 1, 'c': 1})
+		groups := groupSpansByStore(ctx, spans, 4, locate, nil)
+		require.Equal(t, []spanGroup{
+			{spans: roachpb.Spans{spanAt('a')}},
+			{spans: roachpb.Spans{spanAt('b')}},
+			{spans: roachpb.Spans{spanAt('c')}},
+		}, groups)
+	})
+
+	t.Run("hints are summed per group", func(t *testing.T) {
+		spans := roachpb.Spans{spanAt('a'), spanAt('b'), spanAt('c')}
+		locate := fakeLocate(map[byte]roachpb.StoreID{'a': 1, 'b': 1, 'c': 2})
+		hints := []uint64{10, 20, 30}
+		groups := groupSpansByStore(ctx, spans, 4, locate, hints)
+		require.Equal(t, []spanGroup{
+			{spans: roachpb.Spans{spanAt('a'), spanAt('b')}, rowCountHint: 30},
+			{spans: roachpb.Spans{spanAt('c')}, rowCountHint: 30},
+		}, groups)
+	})
+}